@@ -1,11 +1,32 @@
+package lfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rubyist/tracerx"
+)
+
+const (
 	blobSizeCutoff = 1024
+)
+
 var (
 	// Arguments to append to a git log call which will limit the output to
 	// lfs changes and format the output suitable for parseLogOutput.. method(s)
 	logLfsSearchArgs = []string{
 		"-G", "oid sha256:", // only diffs which include an lfs file SHA change
-		"-p",   // include diff so we can read the SHA
-		"-U12", // Make sure diff context is always big enough to support 10 extension lines to get whole pointer
+		"-p",                             // include diff so we can read the SHA
+		"-U12",                           // Make sure diff context is always big enough to support 10 extension lines to get whole pointer
 		`--format=lfs-commit-sha: %H %P`, // just a predictable commit header we can detect
 	}
 )
@@ -13,15 +34,31 @@ var (
 // Reports unique oids once only, not multiple times if >1 file uses the same content
 // Reports unique oids once only, not multiple times if >1 file uses the same content
 
-// An entry from ls-tree or rev-list including a blob sha and tree path
+// An entry from ls-tree or rev-list including a blob object id and tree path
 type TreeBlob struct {
-	Sha1     string
+	// ObjectID is the blob's object id: a 40-character hex SHA-1, or a
+	// 64-character hex SHA-256 in repositories using
+	// --object-format=sha256.
+	ObjectID string
 	Filename string
+
+	// Sha1 is a deprecated alias for ObjectID, despite not always
+	// actually being a SHA-1.
+	//
+	// Deprecated: use ObjectID instead.
+	Sha1 string
 }
 
 // ScanTree takes a ref and returns a slice of WrappedPointer objects in the tree at that ref
 // Differs from ScanRefs in that multiple files in the tree with the same content are all reported
 func ScanTree(ref string) ([]*WrappedPointer, error) {
+	return ScanTreeWithFilter(ref, nil, nil)
+}
+
+// ScanTreeWithFilter is like ScanTree but skips any blob whose path doesn't
+// pass the include/exclude filter before spending a cat-file round trip on
+// it.
+func ScanTreeWithFilter(ref string, includePaths, excludePaths []string) ([]*WrappedPointer, error) {
 	start := time.Now()
 	defer func() {
 		tracerx.PerformanceSince("scan", start)
@@ -29,12 +66,12 @@ func ScanTree(ref string) ([]*WrappedPointer, error) {
 
 	// We don't use the nameMap approach here since that's imprecise when >1 file
 	// can be using the same content
-	treeShas, err := lsTreeBlobs(ref)
+	treeShas, err := lsTreeBlobs(ref, includePaths, excludePaths)
 	if err != nil {
 		return nil, err
 	}
 
-	pointerc, err := catFileBatchTree(treeShas)
+	pointerc, workerErrc, err := catFileBatchTree(treeShas, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -44,70 +81,163 @@ func ScanTree(ref string) ([]*WrappedPointer, error) {
 		pointers = append(pointers, p)
 	}
 
+	if err := <-workerErrc; err != nil {
+		return pointers, err
+	}
+
 	return pointers, nil
 }
 
-// catFileBatchTree uses git cat-file --batch to get the object contents
-// of a git object, given its sha1. The contents will be decoded into
-// a Git LFS pointer. treeblobs is a channel over which blob entries
-// will be sent. It returns a channel from which point.Pointers can be read.
-func catFileBatchTree(treeblobs chan TreeBlob) (chan *WrappedPointer, error) {
-	cmd, err := startCommand("git", "cat-file", "--batch")
+// ScanTreeChan is a streaming variant of ScanTree: pointers are sent to the
+// returned channel as they're decoded rather than buffered into a slice.
+// The error channel receives at most one error and is closed once the scan
+// finishes.
+func ScanTreeChan(ref string) (<-chan *WrappedPointer, <-chan error, error) {
+	start := time.Now()
+
+	treeShas, err := lsTreeBlobs(ref, nil, nil)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	pointers := make(chan *WrappedPointer, chanBufSize)
+	pointerc, workerErrc, err := catFileBatchTree(treeShas, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := make(chan *WrappedPointer, chanBufSize)
+	errc := make(chan error, 1)
 
 	go func() {
-		for t := range treeblobs {
-			cmd.Stdin.Write([]byte(t.Sha1 + "\n"))
-			l, err := cmd.Stdout.ReadBytes('\n')
-			if err != nil {
-				break
-			}
+		defer close(out)
+		defer close(errc)
+		defer tracerx.PerformanceSince("scan", start)
 
-			// Line is formatted:
-			// <sha1> <type> <size>
-			fields := bytes.Fields(l)
-			s, _ := strconv.Atoi(string(fields[2]))
+		for p := range pointerc {
+			out <- p
+		}
+		if err := <-workerErrc; err != nil {
+			errc <- err
+		}
+	}()
 
-			nbuf := make([]byte, s)
-			_, err = io.ReadFull(cmd.Stdout, nbuf)
-			if err != nil {
-				break // Legit errors
-			}
+	return out, errc, nil
+}
 
-			p, err := DecodePointer(bytes.NewBuffer(nbuf))
-			if err == nil {
-				pointers <- &WrappedPointer{
-					Sha1:    string(fields[0]),
-					Size:    p.Size,
-					Pointer: p,
-					Name:    t.Filename,
-				}
-			}
+// catFileBatchTree uses a pool of `git cat-file --batch` workers to get the
+// object contents of the blobs read from treeblobs, decoding each one into
+// a Git LFS pointer and merging the results onto the returned channel.
+// workers controls how many concurrent cat-file processes are spawned; if
+// it's <= 0, runtime.NumCPU() is used. All workers are started before any
+// is launched, so a failed start can't leave an already-running worker
+// orphaned. The returned error channel receives at most one error and is
+// closed once every worker has finished.
+func catFileBatchTree(treeblobs chan TreeBlob, workers int) (chan *WrappedPointer, <-chan error, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
 
-			_, err = cmd.Stdout.ReadBytes('\n') // Extra \n inserted by cat-file
-			if err != nil {
-				break
+	pointers := make(chan *WrappedPointer, chanBufSize)
+	errc := make(chan error, 1)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	reportErr := func(err error) {
+		errOnce.Do(func() { errc <- err })
+	}
+
+	// Start every worker's cat-file process before launching any of the
+	// goroutines that consume treeblobs/write to pointers. That way, if
+	// starting the Nth process fails, none of the earlier ones has
+	// touched treeblobs or pointers yet - we can just close them down and
+	// return the error instead of leaving active workers as orphans that
+	// nobody will ever drain or close.
+	closers := make([]io.Closer, 0, workers)
+	launchers := make([]func(), 0, workers)
+
+	for i := 0; i < workers; i++ {
+		cmd, err := startCommand("git", "cat-file", "--batch")
+		if err != nil {
+			for _, c := range closers {
+				c.Close()
 			}
+			return nil, nil, err
 		}
+		closers = append(closers, cmd.Stdin)
+
+		launchers = append(launchers, func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer cmd.Stdin.Close()
+
+				for t := range treeblobs {
+					if _, err := cmd.Stdin.Write([]byte(t.ObjectID + "\n")); err != nil {
+						reportErr(err)
+						break
+					}
+
+					l, err := cmd.Stdout.ReadBytes('\n')
+					if err != nil {
+						reportErr(err)
+						break
+					}
+
+					// Line is formatted:
+					// <object-id> <type> <size>
+					fields := bytes.Fields(l)
+					s, _ := strconv.Atoi(string(fields[2]))
+
+					nbuf := make([]byte, s)
+					if _, err := io.ReadFull(cmd.Stdout, nbuf); err != nil {
+						reportErr(err)
+						break // Legit errors
+					}
+
+					p, err := DecodePointer(bytes.NewBuffer(nbuf))
+					if err == nil {
+						pointers <- &WrappedPointer{
+							ObjectID: string(fields[0]),
+							Sha1:     string(fields[0]),
+							Size:     p.Size,
+							Pointer:  p,
+							Name:     t.Filename,
+						}
+					}
+
+					if _, err := cmd.Stdout.ReadBytes('\n'); err != nil { // Extra \n inserted by cat-file
+						reportErr(err)
+						break
+					}
+				}
+			}()
+		})
+	}
+
+	for _, launch := range launchers {
+		launch()
+	}
+
+	go func() {
+		wg.Wait()
 		close(pointers)
-		cmd.Stdin.Close()
+		close(errc)
 	}()
 
-	return pointers, nil
+	return pointers, errc, nil
 }
 
 // Use ls-tree at ref to find a list of candidate tree blobs which might be lfs files
 // The returned channel will be sent these blobs which should be sent to catFileBatchTree
-// for final check & conversion to Pointer
-func lsTreeBlobs(ref string) (chan TreeBlob, error) {
+// for final check & conversion to Pointer. Entries whose path doesn't pass
+// the include/exclude filter are skipped before a blob is ever sent, so
+// callers never pay a cat-file round trip for paths they don't want.
+func lsTreeBlobs(ref string, includePaths, excludePaths []string) (chan TreeBlob, error) {
 	// Snapshot using ls-tree
 	lsArgs := []string{"ls-tree",
 		"-r",          // recurse
 		"-l",          // report object size (we'll need this)
+		"-z",          // NUL-delimit entries so paths with newlines/tabs aren't corrupted
 		"--full-tree", // start at the root regardless of where we are in it
 		ref}
 
@@ -121,22 +251,41 @@ func lsTreeBlobs(ref string) (chan TreeBlob, error) {
 	blobs := make(chan TreeBlob, chanBufSize)
 
 	go func() {
-		scanner := bufio.NewScanner(cmd.Stdout)
-		regex := regexp.MustCompile(`^\d+\s+blob\s+([0-9a-zA-Z]{40})\s+(\d+)\s+(.*)$`)
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if match := regex.FindStringSubmatch(line); match != nil {
-				sz, err := strconv.ParseInt(match[2], 10, 64)
-				if err != nil {
-					continue
-				}
-				sha1 := match[1]
-				filename := match[3]
-				if sz < blobSizeCutoff {
-					blobs <- TreeBlob{sha1, filename}
-				}
+		idRegex := regexp.MustCompile(fmt.Sprintf(`^%s$`, objectIDPattern()))
+		reader := bufio.NewReader(cmd.Stdout)
+
+		for {
+			entry, err := reader.ReadString(0)
+			if err != nil {
+				break
+			}
+			entry = strings.TrimSuffix(entry, "\x00")
+
+			// Each entry is "<mode> <type> <object-id> <size>\t<path>";
+			// split on the single tab that separates the metadata from
+			// the (possibly binary) pathname.
+			tab := strings.IndexByte(entry, '\t')
+			if tab < 0 {
+				continue
+			}
+
+			meta := strings.Fields(entry[:tab])
+			if len(meta) != 4 || meta[1] != "blob" || !idRegex.MatchString(meta[2]) {
+				continue
+			}
+
+			sz, err := strconv.ParseInt(meta[3], 10, 64)
+			if err != nil || sz >= blobSizeCutoff {
+				continue
+			}
 
+			filename := entry[tab+1:]
+			if !FilenamePassesIncludeExcludeFilter(filename, includePaths, excludePaths) {
+				continue
 			}
+
+			objectID := meta[2]
+			blobs <- TreeBlob{ObjectID: objectID, Filename: filename, Sha1: objectID}
 		}
 		close(blobs)
 	}()
@@ -144,6 +293,40 @@ func lsTreeBlobs(ref string) (chan TreeBlob, error) {
 	return blobs, nil
 }
 
+// objectIDPattern returns a regex fragment matching a single hex object id
+// for the repository's active hash algorithm, so lsTreeBlobs and
+// parseLogOutputToPointers don't silently drop every entry in a repository
+// initialized with --object-format=sha256.
+func objectIDPattern() string {
+	if objectIDHexLen() == 64 {
+		return "[0-9a-fA-F]{64}"
+	}
+	return "[0-9a-fA-F]{40}"
+}
+
+// objectIDHexLen detects the hex length of object ids in the current
+// repository by asking git for its object format, falling back to
+// measuring HEAD's sha for older git versions that don't know
+// --show-object-format.
+func objectIDHexLen() int {
+	if out, err := gitOneShot("rev-parse", "--show-object-format"); err == nil {
+		switch strings.TrimSpace(out) {
+		case "sha256":
+			return 64
+		case "sha1":
+			return 40
+		}
+	}
+
+	if out, err := gitOneShot("rev-parse", "HEAD"); err == nil {
+		if n := len(strings.TrimSpace(out)); n == 40 || n == 64 {
+			return n
+		}
+	}
+
+	return 40
+}
+
 // ScanUnpushed scans history for all LFS pointers which have been added but not pushed to any remote
 func ScanUnpushed() ([]*WrappedPointer, error) {
 
@@ -188,6 +371,200 @@ func logUnpushedSHAs() (chan *WrappedPointer, error) {
 
 }
 
+// PointerCommit describes a commit whose tree contains an LFS pointer
+// referencing a particular OID, together with enough metadata to present
+// an audit trail of where that content was introduced and is still
+// referenced from.
+type PointerCommit struct {
+	Sha       string
+	Author    string
+	Committer string
+	Date      time.Time
+	Subject   string
+	Parents   []string
+	// Refs holds the branch and/or tag names (if any) that this commit is
+	// reachable from, plus the name git name-rev gives it (which can be
+	// relative to a ref, such as "main~2"), sorted alphabetically.
+	Refs []string
+}
+
+// FindPointerCommits finds every commit across all refs whose diff adds or
+// removes an LFS pointer line referencing oid (a sha256 content hash), and
+// resolves each one to the ref name(s) it's reachable from. This is the
+// reverse of ScanTree/ScanUnpushed: instead of listing the pointers present
+// at a ref, it answers "which commits introduced or removed this object".
+// Commits that carry the pointer unchanged from their parent are not
+// listed. Results are de-duplicated by commit SHA and returned newest-first.
+func FindPointerCommits(oid string) ([]*PointerCommit, error) {
+	start := time.Now()
+	defer func() {
+		tracerx.PerformanceSince("scan", start)
+	}()
+
+	logArgs := []string{"log",
+		"--all",                                 // consider every branch & tag, not just HEAD
+		"-G", fmt.Sprintf("oid sha256:%s", oid), // only diffs which touch this exact oid
+		"-p",   // include diff so we can read the SHA
+		"-U12", // Make sure diff context is always big enough to support 10 extension lines to get whole pointer
+		`--format=lfs-commit-sha: %H %P%n%an <%ae>%n%cn <%ce>%n%aI%n%s`,
+	}
+
+	cmd, err := startCommand("git", logArgs...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin.Close()
+
+	commits, err := parsePointerCommits(cmd.Stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	// De-duplicate by SHA, keeping first-seen order for the resolve pass
+	// below.
+	bySha := make(map[string]*PointerCommit, len(commits))
+	order := make([]string, 0, len(commits))
+	for _, c := range commits {
+		if _, ok := bySha[c.Sha]; !ok {
+			order = append(order, c.Sha)
+			bySha[c.Sha] = c
+		}
+	}
+
+	result := make([]*PointerCommit, 0, len(order))
+	for _, sha := range order {
+		c := bySha[sha]
+		refs, err := resolveRefs(c.Sha)
+		if err != nil {
+			return nil, err
+		}
+		c.Refs = refs
+		result = append(result, c)
+	}
+
+	// Commits made within the same second (common in scripted/squash
+	// workflows) tie on Date; SliceStable keeps those in git log's
+	// already-newest-first order instead of reshuffling them.
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Date.After(result[j].Date)
+	})
+
+	return result, nil
+}
+
+var pointerCommitHeaderRegex = regexp.MustCompile(`^lfs-commit-sha: ([A-Fa-f0-9]+)((?: [A-Fa-f0-9]+)*)`)
+
+// parsePointerCommits reads output from a `git log` invocation using the
+// --format of FindPointerCommits (the lfs-commit-sha header followed by
+// author, committer, author date and subject lines) and extracts one
+// PointerCommit per commit header,
+// ignoring the diff body (the commit has already been selected by -G, so
+// we only need its metadata here).
+func parsePointerCommits(log io.Reader) ([]*PointerCommit, error) {
+	var commits []*PointerCommit
+
+	scanner := bufio.NewScanner(log)
+	for scanner.Scan() {
+		match := pointerCommitHeaderRegex.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+
+		c := &PointerCommit{Sha: match[1]}
+		if parents := strings.Fields(match[2]); len(parents) > 0 {
+			c.Parents = parents
+		}
+
+		if !scanner.Scan() {
+			break
+		}
+		c.Author = scanner.Text()
+
+		if !scanner.Scan() {
+			break
+		}
+		c.Committer = scanner.Text()
+
+		if !scanner.Scan() {
+			break
+		}
+		if date, err := time.Parse(time.RFC3339, scanner.Text()); err == nil {
+			c.Date = date
+		}
+
+		if !scanner.Scan() {
+			break
+		}
+		c.Subject = scanner.Text()
+
+		commits = append(commits, c)
+	}
+
+	return commits, scanner.Err()
+}
+
+// resolveRefs returns the sorted, de-duplicated set of branch and tag names
+// that sha is reachable from, together with the name git name-rev gives sha,
+// which can be relative to a ref (such as "main~2").
+func resolveRefs(sha string) ([]string, error) {
+	refs := make(map[string]struct{})
+
+	if out, err := gitOneShot("name-rev", "--name-only", "--no-undefined", sha); err == nil {
+		if name := strings.TrimSpace(out); name != "" {
+			refs[name] = struct{}{}
+		}
+	}
+
+	if out, err := gitOneShot("branch", "--all", "--contains", sha); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			line = strings.TrimPrefix(strings.TrimSpace(line), "* ")
+			// Skip the "(HEAD detached at ...)"/"(no branch)" placeholder
+			// branch --contains prints for a detached HEAD - it's not a
+			// real ref name.
+			if line != "" && !strings.HasPrefix(line, "(") {
+				refs[line] = struct{}{}
+			}
+		}
+	}
+
+	if out, err := gitOneShot("tag", "--contains", sha); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				refs[line] = struct{}{}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// gitOneShot runs a single git command to completion via the same
+// startCommand entry point as every other git invocation in this file (so
+// it picks up the same working directory, environment and logging), and
+// returns its stdout. It's used for the small, non-streaming queries
+// (name-rev, branch --contains, tag --contains, rev-parse) that don't
+// warrant setting up a channel-fed worker.
+func gitOneShot(args ...string) (string, error) {
+	cmd, err := startCommand("git", args...)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdin.Close()
+
+	out, err := io.ReadAll(cmd.Stdout)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
 // When scanning diffs e.g. parseLogOutputToPointers, which direction of diff to include
 // data from, i.e. '+' or '-'. Depending on what you're scanning for either might be useful
 type LogDiffDirection byte
@@ -223,7 +600,8 @@ func parseLogOutputToPointers(log io.Reader, dir LogDiffDirection,
 	// Also when a binary is changed the diff will include a '-' line for the old SHA
 
 	// Define regexes to capture commit & diff headers
-	commitHeaderRegex := regexp.MustCompile(`^lfs-commit-sha: ([A-Fa-f0-9]{40})(?: ([A-Fa-f0-9]{40}))*`)
+	idPattern := objectIDPattern()
+	commitHeaderRegex := regexp.MustCompile(fmt.Sprintf(`^lfs-commit-sha: (%s)(?: (%s))*`, idPattern, idPattern))
 	fileHeaderRegex := regexp.MustCompile(`diff --git a\/(.+?)\s+b\/(.+)`)
 	fileMergeHeaderRegex := regexp.MustCompile(`diff --cc (.+)`)
 	pointerDataRegex := regexp.MustCompile(`^([\+\- ])(version https://git-lfs|oid sha256|size|ext-).*$`)
@@ -290,4 +668,4 @@ func parseLogOutputToPointers(log io.Reader, dir LogDiffDirection,
 
 	close(results)
 
-}
\ No newline at end of file
+}
@@ -0,0 +1,89 @@
+package lfs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// newSyntheticBatchTreeBlobs hash-objects a single pointer blob into the
+// repo at dir (without touching the working tree or any commit) and
+// returns a fresh TreeBlob channel with count entries all referencing it -
+// duplicate content across many paths being the common case for LFS
+// pointers anyway - suitable for feeding directly into catFileBatchTree.
+func newSyntheticBatchTreeBlobs(b *testing.B, dir string, count int) chan TreeBlob {
+	b.Helper()
+
+	pointer := "version https://git-lfs.github.com/spec/v1\noid sha256:" + testPointerOid + "\nsize 11\n"
+
+	cmd := exec.Command("git", "-C", dir, "hash-object", "-w", "-t", "blob", "--stdin")
+	cmd.Stdin = strings.NewReader(pointer)
+	out, err := cmd.Output()
+	if err != nil {
+		b.Fatalf("git hash-object: %v", err)
+	}
+	id := strings.TrimSpace(string(out))
+
+	blobs := make(chan TreeBlob, count)
+	for i := 0; i < count; i++ {
+		blobs <- TreeBlob{ObjectID: id, Sha1: id, Filename: fmt.Sprintf("blob-%d.bin", i)}
+	}
+	close(blobs)
+
+	return blobs
+}
+
+// BenchmarkCatFileBatchTree demonstrates the speedup from parallelizing
+// cat-file workers: it decodes a synthetic tree of 100k pointer blobs with
+// a single worker and with runtime.NumCPU() workers. Run with:
+//
+//	go test ./lfs -run NONE -bench CatFileBatchTree
+func BenchmarkCatFileBatchTree(b *testing.B) {
+	const blobCount = 100000
+
+	dir := b.TempDir()
+	if out, err := exec.Command("git", "init", dir).CombinedOutput(); err != nil {
+		b.Fatalf("git init: %v\n%s", err, out)
+	}
+
+	// catFileBatchTree's cat-file processes, like every other git
+	// invocation in this package, run against the process's current
+	// directory rather than taking an explicit repo path.
+	wd, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	for _, workers := range []int{1, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				treeblobs := newSyntheticBatchTreeBlobs(b, dir, blobCount)
+				b.StartTimer()
+
+				pointerc, errc, err := catFileBatchTree(treeblobs, workers)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				got := 0
+				for range pointerc {
+					got++
+				}
+				if err := <-errc; err != nil {
+					b.Fatal(err)
+				}
+				if got != blobCount {
+					b.Fatalf("expected %d pointers, got %d", blobCount, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package lfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testGitRepo initializes a fresh repository using the given
+// --object-format in a temp directory and configures a commit identity, so
+// callers can `git commit` in it without a global user.name/user.email.
+// Tests are skipped on a git binary too old to know --object-format.
+func testGitRepo(t *testing.T, objectFormat string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if out, err := exec.Command("git", "init", "--object-format="+objectFormat, dir).CombinedOutput(); err != nil {
+		t.Skipf("git does not support --object-format=%s: %v\n%s", objectFormat, err, out)
+	}
+
+	runGit(t, dir, "config", "user.email", "test@example.com")
+	runGit(t, dir, "config", "user.name", "Test")
+
+	return dir
+}
+
+// runGit runs git in dir and fails the test if it returns an error.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// runGitStdin is runGit for commands that read from stdin, such as
+// `mktree -z`, returning the trimmed stdout.
+func runGitStdin(t *testing.T, dir string, stdin []byte, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commitAt runs `git commit` in dir with both author and committer dates
+// pinned to date (RFC3339), so commits made back-to-back in a fast test
+// don't tie on git's one-second timestamp resolution.
+func commitAt(t *testing.T, dir, date string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir, "commit"}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git commit %v: %v\n%s", args, err, out)
+	}
+}
+
+// chdir changes the working directory to dir for the duration of the test,
+// restoring it on cleanup. ScanTree/ScanUnpushed operate on the process's
+// current directory, like every other git invocation in scanner.go.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+}
+
+const testPointerOid = "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+
+func writeTestPointer(t *testing.T, dir, name string) {
+	t.Helper()
+
+	contents := "version https://git-lfs.github.com/spec/v1\n" +
+		"oid sha256:" + testPointerOid + "\n" +
+		"size 11\n"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestScanTreeSHA256Repo verifies that ScanTree finds an LFS pointer
+// committed to a repository initialized with --object-format=sha256, where
+// both commit and blob object ids are 64 hex characters rather than 40.
+func TestScanTreeSHA256Repo(t *testing.T) {
+	dir := testGitRepo(t, "sha256")
+	writeTestPointer(t, dir, "file.bin")
+	runGit(t, dir, "add", "file.bin")
+	runGit(t, dir, "commit", "-m", "add pointer")
+
+	chdir(t, dir)
+
+	pointers, err := ScanTree("HEAD")
+	if err != nil {
+		t.Fatalf("ScanTree: %v", err)
+	}
+
+	if len(pointers) != 1 {
+		t.Fatalf("expected 1 pointer, got %d", len(pointers))
+	}
+	if pointers[0].Oid != testPointerOid {
+		t.Errorf("unexpected oid: %s", pointers[0].Oid)
+	}
+	if len(pointers[0].ObjectID) != 64 {
+		t.Errorf("expected a 64-character sha256 object id, got %q (%d chars)", pointers[0].ObjectID, len(pointers[0].ObjectID))
+	}
+}
+
+// TestScanUnpushedSHA256Repo verifies that ScanUnpushed finds the same
+// pointer when it's only reachable from a local branch with no remote,
+// in a SHA-256 repository.
+func TestScanUnpushedSHA256Repo(t *testing.T) {
+	dir := testGitRepo(t, "sha256")
+	writeTestPointer(t, dir, "file.bin")
+	runGit(t, dir, "add", "file.bin")
+	runGit(t, dir, "commit", "-m", "add pointer")
+
+	chdir(t, dir)
+
+	pointers, err := ScanUnpushed()
+	if err != nil {
+		t.Fatalf("ScanUnpushed: %v", err)
+	}
+
+	if len(pointers) != 1 {
+		t.Fatalf("expected 1 pointer, got %d", len(pointers))
+	}
+	if pointers[0].Oid != testPointerOid {
+		t.Errorf("unexpected oid: %s", pointers[0].Oid)
+	}
+}
+
+// TestScanTreeOddFilename verifies that ScanTree still finds a pointer whose
+// path contains a tab and a newline, built directly with mktree/commit-tree
+// since such a path can't go through the index - the exact case the old
+// line-oriented ls-tree parser used to corrupt and silently drop.
+func TestScanTreeOddFilename(t *testing.T) {
+	dir := testGitRepo(t, "sha1")
+	writeTestPointer(t, dir, "tmp.bin")
+
+	blobSha := strings.TrimSpace(runGit(t, dir, "hash-object", "-w", "tmp.bin"))
+
+	oddName := "weird\tname\nwith-control-chars.bin"
+	entry := []byte(fmt.Sprintf("100644 blob %s\t%s\x00", blobSha, oddName))
+	treeSha := runGitStdin(t, dir, entry, "mktree", "-z")
+
+	commitSha := strings.TrimSpace(runGit(t, dir, "commit-tree", treeSha, "-m", "odd filename"))
+
+	chdir(t, dir)
+
+	pointers, err := ScanTree(commitSha)
+	if err != nil {
+		t.Fatalf("ScanTree: %v", err)
+	}
+
+	if len(pointers) != 1 {
+		t.Fatalf("expected 1 pointer, got %d", len(pointers))
+	}
+	if pointers[0].Name != oddName {
+		t.Errorf("expected filename %q, got %q", oddName, pointers[0].Name)
+	}
+}
+
+// TestScanTreeWithFilter verifies that ScanTreeWithFilter only returns
+// pointers whose path passes the include/exclude filter.
+func TestScanTreeWithFilter(t *testing.T) {
+	dir := testGitRepo(t, "sha1")
+	writeTestPointer(t, dir, "keep.bin")
+	writeTestPointer(t, dir, "skip.bin")
+	runGit(t, dir, "add", "keep.bin", "skip.bin")
+	runGit(t, dir, "commit", "-m", "add pointers")
+
+	chdir(t, dir)
+
+	included, err := ScanTreeWithFilter("HEAD", []string{"keep.bin"}, nil)
+	if err != nil {
+		t.Fatalf("ScanTreeWithFilter include: %v", err)
+	}
+	if len(included) != 1 || included[0].Name != "keep.bin" {
+		t.Fatalf("expected only keep.bin from include filter, got %+v", included)
+	}
+
+	excluded, err := ScanTreeWithFilter("HEAD", nil, []string{"skip.bin"})
+	if err != nil {
+		t.Fatalf("ScanTreeWithFilter exclude: %v", err)
+	}
+	if len(excluded) != 1 || excluded[0].Name != "keep.bin" {
+		t.Fatalf("expected only keep.bin after excluding skip.bin, got %+v", excluded)
+	}
+}
+
+// TestFindPointerCommits verifies that FindPointerCommits returns every
+// commit that introduces a pointer for a given oid, newest-first, with
+// parents and resolved branch names intact.
+func TestFindPointerCommits(t *testing.T) {
+	dir := testGitRepo(t, "sha1")
+
+	runGit(t, dir, "commit", "--allow-empty", "-m", "root")
+
+	writeTestPointer(t, dir, "a.bin")
+	runGit(t, dir, "add", "a.bin")
+	// Pin author/committer dates a minute apart: back-to-back commits in a
+	// fast test can otherwise tie on git's one-second timestamp resolution,
+	// making the newest-first ordering this test checks nondeterministic.
+	commitAt(t, dir, "2024-01-01T00:00:00Z", "-m", "add a.bin")
+	firstSha := strings.TrimSpace(runGit(t, dir, "rev-parse", "HEAD"))
+
+	runGit(t, dir, "branch", "feature", firstSha)
+
+	writeTestPointer(t, dir, "b.bin")
+	runGit(t, dir, "add", "b.bin")
+	commitAt(t, dir, "2024-01-01T00:01:00Z", "-m", "add b.bin")
+	secondSha := strings.TrimSpace(runGit(t, dir, "rev-parse", "HEAD"))
+
+	defaultBranch := strings.TrimSpace(runGit(t, dir, "branch", "--show-current"))
+
+	chdir(t, dir)
+
+	commits, err := FindPointerCommits(testPointerOid)
+	if err != nil {
+		t.Fatalf("FindPointerCommits: %v", err)
+	}
+
+	if len(commits) != 2 {
+		t.Fatalf("expected 2 commits, got %d: %+v", len(commits), commits)
+	}
+
+	if commits[0].Sha != secondSha || commits[1].Sha != firstSha {
+		t.Fatalf("expected newest-first [%s, %s], got [%s, %s]", secondSha, firstSha, commits[0].Sha, commits[1].Sha)
+	}
+
+	if len(commits[0].Parents) != 1 || commits[0].Parents[0] != firstSha {
+		t.Errorf("expected %s's parent to be %s, got %v", secondSha, firstSha, commits[0].Parents)
+	}
+
+	if !stringSliceContains(commits[0].Refs, defaultBranch) {
+		t.Errorf("expected %s to resolve to branch %q, got %v", secondSha, defaultBranch, commits[0].Refs)
+	}
+	if stringSliceContains(commits[0].Refs, "feature") {
+		t.Errorf("did not expect %s to resolve to the feature branch, got %v", secondSha, commits[0].Refs)
+	}
+
+	if !stringSliceContains(commits[1].Refs, "feature") {
+		t.Errorf("expected %s to resolve to branch feature, got %v", firstSha, commits[1].Refs)
+	}
+}
+
+func stringSliceContains(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}